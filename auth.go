@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/google/go-containerregistry/authn"
+	"github.com/google/go-containerregistry/authn/amazon"
+	"github.com/google/go-containerregistry/authn/github"
+	"github.com/google/go-containerregistry/authn/google"
+	"github.com/pkg/errors"
+)
+
+// AuthConfig describes the registry credentials a caller can supply instead
+// of relying on ~/.docker/config.json, so artificer can run as a library in
+// CI controllers that already hold credentials in memory.
+type AuthConfig struct {
+	// Registries maps a registry hostname to the credentials to use for it.
+	Registries map[string]RegistryAuth `json:"registries"`
+}
+
+// RegistryAuth is a single registry's credentials: either a static bearer
+// token or a basic-auth username/password pair.
+type RegistryAuth struct {
+	Token    string `json:"token"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// BuildKeychain composes an authn.Keychain from cfg layered on top of the
+// cloud-provider credential helpers (GCR, ECR, GHCR) and falls back to
+// authn.DefaultKeychain for anything not explicitly configured, so
+// ~/.docker/config.json keeps working unless overridden.
+func BuildKeychain(cfg AuthConfig) authn.Keychain {
+	return authn.NewMultiKeychain(
+		staticKeychain{cfg.Registries},
+		google.Keychain,
+		amazon.Keychain,
+		github.Keychain,
+		authn.DefaultKeychain,
+	)
+}
+
+// staticKeychain resolves credentials supplied directly in an AuthConfig,
+// taking precedence over every credential helper it's layered in front of.
+type staticKeychain struct {
+	registries map[string]RegistryAuth
+}
+
+func (k staticKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	auth, ok := k.registries[target.RegistryStr()]
+	if !ok {
+		return authn.Anonymous, nil
+	}
+
+	if auth.Token != "" {
+		return &authn.Bearer{Token: auth.Token}, nil
+	}
+
+	return &authn.Basic{Username: auth.Username, Password: auth.Password}, nil
+}
+
+// loadAuthConfig reads an AuthConfig from the JSON file at path.
+func loadAuthConfig(path string) (AuthConfig, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return AuthConfig{}, errors.Wrapf(err, "reading auth config (%s)", path)
+	}
+
+	var cfg AuthConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return AuthConfig{}, errors.Wrapf(err, "parsing auth config (%s)", path)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/google/go-containerregistry/authn"
+	"github.com/google/go-containerregistry/name"
+	v1 "github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/empty"
+	"github.com/google/go-containerregistry/v1/mutate"
+	"github.com/google/go-containerregistry/v1/remote"
+	"github.com/pkg/errors"
+)
+
+// getImages resolves one base image per entry in sourceURLs, preserving
+// order so callers can match built images back to their base.
+func getImages(sourceURLs []string, kc authn.Keychain) ([]v1.Image, []name.Repository, error) {
+	images := make([]v1.Image, len(sourceURLs))
+	repositories := make([]name.Repository, len(sourceURLs))
+
+	for i, sourceURL := range sourceURLs {
+		image, repository, err := getImage(sourceURL, kc)
+		if err != nil {
+			return nil, nil, err
+		}
+		images[i] = image
+		repositories[i] = repository
+	}
+
+	return images, repositories, nil
+}
+
+// platformFor reads the Architecture/OS that an index manifest should
+// advertise for image, from its config file. run() calls it once per base
+// image, before any new layers are appended.
+func platformFor(image v1.Image) (v1.Platform, error) {
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return v1.Platform{}, errors.Wrap(err, "reading config file")
+	}
+
+	return v1.Platform{Architecture: cfg.Architecture, OS: cfg.OS}, nil
+}
+
+// buildImageIndex assembles images into a single v1.ImageIndex, one
+// manifest per platform, using platforms[i] as the Platform descriptor for
+// images[i] so a single multi-arch reference can be pushed and resolved
+// correctly regardless of the pulling architecture.
+func buildImageIndex(images []v1.Image, platforms []v1.Platform) (v1.ImageIndex, error) {
+	index := empty.Index
+
+	for i, image := range images {
+		platform := platforms[i]
+
+		var err error
+		index, err = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add: image,
+			Descriptor: v1.Descriptor{
+				Platform: &platform,
+			},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "appending manifest")
+		}
+	}
+
+	return index, nil
+}
+
+// pushIndex pushes index to destURL as a single multi-platform reference.
+func pushIndex(index v1.ImageIndex, destURL string, kc authn.Keychain) error {
+	destRef, err := name.ParseReference(destURL, name.WeakValidation)
+	if err != nil {
+		return errors.Wrapf(err, "parsing destination URL (%s)", destURL)
+	}
+
+	pushAuth, err := kc.Resolve(destRef.Context().Registry)
+	if err != nil {
+		return errors.Wrapf(err, "authenticating target (%s)", destURL)
+	}
+
+	return remote.WriteIndex(destRef, index, pushAuth, http.DefaultTransport)
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"archive/tar"
-	"bytes"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,11 +25,17 @@ import (
 )
 
 type params struct {
-	Target    string   `arg:"-t,required" help:"destination image GCR-URL"`
-	BaseImage string   `arg:"-b,required" help:"base image GCR-URL"`
-	Files     []string `arg:"-f,separate" help:"Specify a file to add"`
-	Env       []string `arg:"-e,separate" help:"Environment Variables"`
-	Cmd       string   `arg:"-c" help:"Command to run when starting the container"`
+	Target     string   `arg:"-t,required" help:"destination image GCR-URL"`
+	BaseImage  []string `arg:"-b,required,separate" help:"base image GCR-URL; repeat to build a multi-platform index, one base per platform"`
+	Files      []string `arg:"-f,separate" help:"Specify a file to add"`
+	Env        []string `arg:"-e,separate" help:"Environment Variables"`
+	Cmd        string   `arg:"-c" help:"Command to run when starting the container"`
+	Recipe     string   `arg:"-r" help:"Path to a Dockerfile-like recipe file describing multiple build steps"`
+	Output     string   `arg:"-o" help:"Write the image to this local path (tarball, or OCI layout dir if ending in /) instead of pushing it"`
+	Timestamp  string   `arg:"--timestamp" help:"Unix timestamp for layer/config metadata, for reproducible builds (defaults to SOURCE_DATE_EPOCH env, then the epoch)"`
+	SignKey    string   `arg:"--sign-key" help:"Path to a PEM-encoded ECDSA private key; signs the pushed manifest and pushes a cosign-compatible sha256-<digest>.sig tag"`
+	SBOM       string   `arg:"--sbom" help:"Path to an SPDX/CycloneDX SBOM document to attach as a sha256-<digest>.sbom tag"`
+	AuthConfig string   `arg:"--auth-config" help:"Path to a JSON file with per-registry credentials, layered in front of cloud credential helpers and the docker keychain"`
 }
 
 func main() {
@@ -42,26 +49,117 @@ func run() error {
 	p := &params{}
 	arg.MustParse(p)
 
+	if len(p.BaseImage) > 1 && (p.Output != "" || p.SignKey != "" || p.SBOM != "") {
+		return errors.New("-o/--sign-key/--sbom are not yet supported together with multiple -b (multi-platform index) flags")
+	}
+
+	if p.Output != "" && (p.SignKey != "" || p.SBOM != "") {
+		return errors.New("-o/--output is not yet supported together with --sign-key/--sbom; push without -o to sign or attach an SBOM")
+	}
+
+	tf := &tempFiles{}
+	defer tf.cleanup()
+
+	kc := authn.DefaultKeychain
+	if p.AuthConfig != "" {
+		cfg, err := loadAuthConfig(p.AuthConfig)
+		if err != nil {
+			return err
+		}
+		kc = BuildKeychain(cfg)
+	}
+
 	fmt.Println("Checking base image...")
 
-	baseImage, repository, err := getImage(p.BaseImage)
+	baseImages, repositories, err := getImages(p.BaseImage, kc)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Building new image...")
-
-	finalImage, err := buildNewImage(p.Files, p.Env, p.Cmd, baseImage)
+	ts, err := resolveTimestamp(p)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Pushing...")
+	// Capture each base's platform off the base image itself, before
+	// buildImageFrom mutates it; the index descriptors use these values.
+	platforms := make([]v1.Platform, len(baseImages))
+	for i, baseImage := range baseImages {
+		platforms[i], err = platformFor(baseImage)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Building new image...")
 
-	if err := pushImage(finalImage, []name.Repository{
-		repository,
-	}, p.Target); err != nil {
-		return err
+	finalImages := make([]v1.Image, len(baseImages))
+	for i, baseImage := range baseImages {
+		finalImages[i], err = buildImageFrom(p, baseImage, ts, tf)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(finalImages) > 1 {
+		fmt.Println("Assembling image index...")
+
+		index, err := buildImageIndex(finalImages, platforms)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("Pushing index...")
+
+		if err := pushIndex(index, p.Target, kc); err != nil {
+			return err
+		}
+
+		fmt.Println("Done.")
+
+		return nil
+	}
+
+	finalImage := finalImages[0]
+
+	if p.Output != "" {
+		fmt.Println("Writing...")
+
+		destRef, err := name.ParseReference(p.Target, name.WeakValidation)
+		if err != nil {
+			return errors.Wrapf(err, "parsing destination reference (%s)", p.Target)
+		}
+
+		if err := writeImage(finalImage, destRef, p.Output); err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("Pushing...")
+
+		if err := pushImage(finalImage, repositories[:1], p.Target, kc); err != nil {
+			return err
+		}
+
+		destRef, err := name.ParseReference(p.Target, name.WeakValidation)
+		if err != nil {
+			return errors.Wrapf(err, "parsing destination reference (%s)", p.Target)
+		}
+
+		if p.SignKey != "" {
+			fmt.Println("Signing...")
+
+			if err := signAndPush(finalImage, destRef, p.SignKey, kc); err != nil {
+				return err
+			}
+		}
+
+		if p.SBOM != "" {
+			fmt.Println("Attaching SBOM...")
+
+			if err := sbomAndPush(finalImage, destRef, p.SBOM, kc); err != nil {
+				return err
+			}
+		}
 	}
 
 	fmt.Println("Done.")
@@ -69,13 +167,55 @@ func run() error {
 	return nil
 }
 
-func buildNewImage(files, env []string, cmd string, baseImage v1.Image) (v1.Image, error) {
-	image, err := applyConfig(baseImage, env, cmd)
+// buildImageFrom builds a single platform's image from baseImage, using the
+// recipe file if one was given, or the single-shot -f/-e/-c flags
+// otherwise. Any layer tarballs spooled to disk along the way are recorded
+// in tf so the caller can remove them once the build has actually been
+// pushed or written.
+func buildImageFrom(p *params, baseImage v1.Image, ts time.Time, tf *tempFiles) (v1.Image, error) {
+	if p.Recipe != "" {
+		steps, err := parseRecipe(p.Recipe)
+		if err != nil {
+			return nil, err
+		}
+
+		return buildFromRecipe(baseImage, steps, ts, tf)
+	}
+
+	return buildNewImage(p.Files, p.Env, p.Cmd, baseImage, ts, tf)
+}
+
+// resolveTimestamp determines the fixed timestamp to stamp onto layers and
+// config history so that builds are reproducible: it prefers --timestamp,
+// falls back to SOURCE_DATE_EPOCH, and otherwise uses the Unix epoch
+// rather than time.Now().
+func resolveTimestamp(p *params) (time.Time, error) {
+	if p.Timestamp != "" {
+		return parseUnixTimestamp(p.Timestamp)
+	}
+
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		return parseUnixTimestamp(epoch)
+	}
+
+	return time.Unix(0, 0).UTC(), nil
+}
+
+func parseUnixTimestamp(s string) (time.Time, error) {
+	sec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "parsing unix timestamp (%s)", s)
+	}
+	return time.Unix(sec, 0).UTC(), nil
+}
+
+func buildNewImage(files, env []string, cmd string, baseImage v1.Image, ts time.Time, tf *tempFiles) (v1.Image, error) {
+	image, err := applyConfig(baseImage, env, cmd, ts)
 	if err != nil {
 		return nil, errors.Wrap(err, "applying config")
 	}
 
-	image, err = addNewLayerFromFiles(image, files)
+	image, err = addNewLayerFromFiles(image, files, ts, tf)
 	if err != nil {
 		return nil, errors.Wrap(err, "adding layer")
 	}
@@ -83,7 +223,7 @@ func buildNewImage(files, env []string, cmd string, baseImage v1.Image) (v1.Imag
 	return image, nil
 }
 
-func applyConfig(image v1.Image, env []string, cmd string) (v1.Image, error) {
+func applyConfig(image v1.Image, env []string, cmd string, ts time.Time) (v1.Image, error) {
 	imageConfig, err := image.ConfigFile()
 	if err != nil {
 		return nil, errors.Wrap(err, "creating config file")
@@ -96,7 +236,7 @@ func applyConfig(image v1.Image, env []string, cmd string) (v1.Image, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "applying new config")
 	}
-	newImage, err = mutate.CreatedAt(newImage, v1.Time{Time: time.Now()})
+	newImage, err = mutate.CreatedAt(newImage, v1.Time{Time: ts})
 	if err != nil {
 		return nil, errors.Wrap(err, "setting created-at timestamp")
 	}
@@ -104,19 +244,50 @@ func applyConfig(image v1.Image, env []string, cmd string) (v1.Image, error) {
 	return newImage, nil
 }
 
-func addNewLayerFromFiles(image v1.Image, files []string) (v1.Image, error) {
-	// the .tar file from the passed files will be our new layer
-	bb := bytes.Buffer{}
-	if err := createTarFile(files, &bb); err != nil {
+// tempFiles tracks layer tarballs spooled to disk over the course of a
+// build, so the caller can remove them once the resulting image has
+// actually been pushed or written - every reader of a tarball.LayerFromOpener
+// re-opens the path by name, so the file must outlive the build itself and
+// can only be cleaned up afterwards.
+type tempFiles struct {
+	paths []string
+}
+
+func (tf *tempFiles) add(path string) {
+	tf.paths = append(tf.paths, path)
+}
+
+// cleanup removes every tracked path, best-effort: a file that's already
+// gone isn't worth failing the build over at this point.
+func (tf *tempFiles) cleanup() {
+	for _, path := range tf.paths {
+		os.Remove(path)
+	}
+}
+
+func addNewLayerFromFiles(image v1.Image, files []string, ts time.Time, tf *tempFiles) (v1.Image, error) {
+	// Spool the tar to a temp file instead of buffering it in memory:
+	// go-containerregistry needs to read the layer blob more than once
+	// (digest, then upload), and callers such as recipe steps read the
+	// image's ConfigFile() again right after this call returns - neither
+	// survives a single-pass stream.Layer, which can only ever be drained
+	// once. The path is recorded in tf so it gets removed once the caller
+	// is done pushing or writing the final image.
+	tmp, err := ioutil.TempFile("", "artificer-layer-*.tar")
+	if err != nil {
+		return nil, errors.Wrap(err, "creating temp layer file")
+	}
+	defer tmp.Close()
+	tf.add(tmp.Name())
+
+	if err := createTarFile(files, tmp, ts); err != nil {
 		return nil, errors.Wrap(err, "creating tar archive")
 	}
 
-	// wrapper for LayerFromOpener
 	opener := func() (io.ReadCloser, error) {
-		return ioutil.NopCloser(bytes.NewReader(bb.Bytes())), nil
+		return os.Open(tmp.Name())
 	}
 
-	// create new layer from our .tar
 	l, err := tarball.LayerFromOpener(opener)
 	if err != nil {
 		return nil, errors.Wrap(err, "creating layer")
@@ -130,13 +301,13 @@ func addNewLayerFromFiles(image v1.Image, files []string) (v1.Image, error) {
 	return image, nil
 }
 
-func pushImage(image v1.Image, repositories []name.Repository, destURL string) error {
+func pushImage(image v1.Image, repositories []name.Repository, destURL string, kc authn.Keychain) error {
 	destRef, err := name.ParseReference(destURL, name.WeakValidation)
 	if err != nil {
 		return errors.Wrapf(err, "parsing destination URL (%s)", destURL)
 	}
 
-	pushAuth, err := authn.DefaultKeychain.Resolve(destRef.Context().Registry)
+	pushAuth, err := kc.Resolve(destRef.Context().Registry)
 	if err != nil {
 		return errors.Wrapf(err, "authenticating target (%s)", destURL)
 	}
@@ -147,13 +318,13 @@ func pushImage(image v1.Image, repositories []name.Repository, destURL string) e
 	return remote.Write(destRef, image, pushAuth, http.DefaultTransport, wo)
 }
 
-func getImage(sourceURL string) (v1.Image, name.Repository, error) {
+func getImage(sourceURL string, kc authn.Keychain) (v1.Image, name.Repository, error) {
 	ref, err := parseImageURL(sourceURL)
 	if err != nil {
 		return nil, name.Repository{}, errors.Wrap(err, "parsing source URL")
 	}
 
-	auth, err := authn.DefaultKeychain.Resolve(ref.Context().Registry)
+	auth, err := kc.Resolve(ref.Context().Registry)
 	if err != nil {
 		return nil, name.Repository{}, errors.Wrap(err, "authenticating")
 	}
@@ -174,13 +345,35 @@ func parseImageURL(url string) (name.Reference, error) {
 	return ref, nil
 }
 
-// from https://github.com/verybluebot/tarinator-go/blob/master/tarinator.go
-func createTarFile(paths []string, writer io.Writer) error {
+// tarEntry is a single file or directory queued for writing into a layer
+// tarball, collected up front so entries can be sorted before writing.
+type tarEntry struct {
+	path   string
+	header *tar.Header
+}
+
+// from https://github.com/verybluebot/tarinator-go/blob/master/tarinator.go,
+// reworked to produce byte-identical layers across runs: entries are
+// collected, sorted lexicographically by name, then written with their
+// timestamps set to ts so the resulting tar (and therefore the layer
+// digest) doesn't depend on walk order or wall-clock time.
+func createTarFile(paths []string, writer io.Writer, ts time.Time) error {
+	var entries []tarEntry
+	for _, p := range paths {
+		collected, err := tarwalk(p)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, collected...)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].header.Name < entries[j].header.Name })
+
 	tw := tar.NewWriter(writer)
 	defer tw.Close()
 
-	for _, i := range paths {
-		if err := tarwalk(i, tw); err != nil {
+	for _, e := range entries {
+		if err := writeTarEntry(tw, e, ts); err != nil {
 			return err
 		}
 	}
@@ -188,10 +381,10 @@ func createTarFile(paths []string, writer io.Writer) error {
 	return nil
 }
 
-func tarwalk(source string, tw *tar.Writer) error {
+func tarwalk(source string) ([]tarEntry, error) {
 	info, err := os.Stat(source)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var baseDir string
@@ -199,7 +392,8 @@ func tarwalk(source string, tw *tar.Writer) error {
 		baseDir = filepath.Base(source)
 	}
 
-	return filepath.Walk(source,
+	var entries []tarEntry
+	err = filepath.Walk(source,
 		func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
@@ -213,24 +407,53 @@ func tarwalk(source string, tw *tar.Writer) error {
 				header.Name = filepath.ToSlash(filepath.Join(baseDir, strings.TrimPrefix(path, source)))
 			}
 
-			if err := tw.WriteHeader(header); err != nil {
-				return err
-			}
+			entries = append(entries, tarEntry{path: path, header: header})
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
 
-			if info.IsDir() {
-				return nil
-			}
+	return entries, nil
+}
 
-			if !info.Mode().IsRegular() {
-				return nil
-			}
+// writeTarEntry writes a single entry's header and (if a regular file) its
+// contents, normalizing every field that would otherwise vary between
+// identical builds: timestamps are all set to ts, ownership is zeroed, and
+// the format is fixed to PAX so Go's tar writer doesn't pick a format based
+// on the data it happens to see.
+func writeTarEntry(tw *tar.Writer, e tarEntry, ts time.Time) error {
+	header := e.header
+	header.ModTime = ts
+	header.AccessTime = ts
+	header.ChangeTime = ts
+	header.Uid = 0
+	header.Gid = 0
+	header.Uname = ""
+	header.Gname = ""
+	header.Xattrs = nil
+	header.PAXRecords = nil
+	header.Format = tar.FormatPAX
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
 
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
-			_, err = io.Copy(tw, file)
-			return err
-		})
+	info, err := os.Lstat(e.path)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() || !info.Mode().IsRegular() {
+		return nil
+	}
+
+	file, err := os.Open(e.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(tw, file)
+	return err
 }
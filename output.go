@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/google/go-containerregistry/name"
+	v1 "github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/empty"
+	"github.com/google/go-containerregistry/v1/layout"
+	"github.com/google/go-containerregistry/v1/mutate"
+	"github.com/google/go-containerregistry/v1/tarball"
+	"github.com/pkg/errors"
+)
+
+// writeImage writes image to outputPath on disk instead of pushing it to a
+// registry, so artificer can run in environments without registry
+// credentials and hand the artifact to another CI step. A path ending in
+// "/" is treated as an OCI image layout directory (layout.Write); anything
+// else is written as a docker-save style tarball tagged as tagRef.
+func writeImage(image v1.Image, tagRef name.Reference, outputPath string) error {
+	if strings.HasSuffix(outputPath, "/") {
+		// layout.Write takes a v1.ImageIndex, not a bare v1.Image, so wrap
+		// it as the sole manifest of a fresh index.
+		index, err := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: image})
+		if err != nil {
+			return errors.Wrap(err, "wrapping image as an index")
+		}
+
+		if err := layout.Write(outputPath, index); err != nil {
+			return errors.Wrapf(err, "writing OCI image layout (%s)", outputPath)
+		}
+		return nil
+	}
+
+	if err := tarball.WriteToFile(outputPath, tagRef, image); err != nil {
+		return errors.Wrapf(err, "writing image tarball (%s)", outputPath)
+	}
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/mutate"
+	"github.com/pkg/errors"
+)
+
+// step is a single instruction parsed from a recipe file, modeled after a
+// Dockerfile instruction (COPY, ADD, ENV, WORKDIR, USER, EXPOSE, LABEL,
+// ENTRYPOINT, CMD).
+type step struct {
+	instruction string
+	args        []string
+}
+
+// parseRecipe reads a minimal Dockerfile-like recipe file and returns its
+// steps in order. Blank lines and lines starting with "#" are ignored.
+func parseRecipe(path string) ([]step, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening recipe (%s)", path)
+	}
+	defer f.Close()
+
+	var steps []step
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		steps = append(steps, step{
+			instruction: strings.ToUpper(fields[0]),
+			args:        fields[1:],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading recipe")
+	}
+
+	return steps, nil
+}
+
+// buildFromRecipe applies each step of a recipe to baseImage in order,
+// committing a distinct layer or config mutation per instruction so the
+// resulting image mirrors how real builders commit one layer per
+// instruction, rather than one fat tar layer plus a single config mutation.
+// Each COPY/ADD step spools its own layer tarball to disk; tf collects
+// those paths so the caller can remove them once the built image has
+// actually been pushed or written.
+func buildFromRecipe(baseImage v1.Image, steps []step, ts time.Time, tf *tempFiles) (v1.Image, error) {
+	image := baseImage
+
+	for _, s := range steps {
+		var err error
+
+		switch s.instruction {
+		case "COPY", "ADD":
+			image, err = addNewLayerFromFiles(image, s.args, ts, tf)
+		case "ENV":
+			image, err = applyEnv(image, s.args)
+		case "WORKDIR":
+			image, err = applyWorkdir(image, s.args)
+		case "USER":
+			image, err = applyUser(image, s.args)
+		case "EXPOSE":
+			image, err = applyExpose(image, s.args)
+		case "LABEL":
+			image, err = applyLabel(image, s.args)
+		case "ENTRYPOINT":
+			image, err = applyEntrypoint(image, s.args)
+		case "CMD":
+			image, err = applyCmdArgs(image, s.args)
+		default:
+			return nil, errors.Errorf("unknown recipe instruction %q", s.instruction)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "applying %s", s.instruction)
+		}
+
+		image, err = commitHistory(image, s, ts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "recording history for %s", s.instruction)
+		}
+	}
+
+	return image, nil
+}
+
+// commitHistory appends a v1.History entry describing step to image's
+// config, so downstream tooling sees a per-instruction commit the same way
+// it would for a real Dockerfile build.
+func commitHistory(image v1.Image, s step, ts time.Time) (v1.Image, error) {
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+
+	cfg.History = append(cfg.History, v1.History{
+		Created:   v1.Time{Time: ts},
+		CreatedBy: s.instruction + " " + strings.Join(s.args, " "),
+		Comment:   "artificer recipe step",
+	})
+
+	return mutate.ConfigFile(image, cfg)
+}
+
+func applyEnv(image v1.Image, args []string) (v1.Image, error) {
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+
+	cfg.Config.Env = append(cfg.Config.Env, args...)
+
+	return mutate.Config(image, cfg.Config)
+}
+
+func applyWorkdir(image v1.Image, args []string) (v1.Image, error) {
+	if len(args) != 1 {
+		return nil, errors.New("WORKDIR takes exactly one argument")
+	}
+
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+
+	cfg.Config.WorkingDir = args[0]
+
+	return mutate.Config(image, cfg.Config)
+}
+
+func applyUser(image v1.Image, args []string) (v1.Image, error) {
+	if len(args) != 1 {
+		return nil, errors.New("USER takes exactly one argument")
+	}
+
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+
+	cfg.Config.User = args[0]
+
+	return mutate.Config(image, cfg.Config)
+}
+
+func applyExpose(image v1.Image, args []string) (v1.Image, error) {
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+
+	if cfg.Config.ExposedPorts == nil {
+		cfg.Config.ExposedPorts = map[string]struct{}{}
+	}
+	for _, port := range args {
+		if _, _, err := parsePort(port); err != nil {
+			return nil, err
+		}
+		cfg.Config.ExposedPorts[port+"/tcp"] = struct{}{}
+	}
+
+	return mutate.Config(image, cfg.Config)
+}
+
+func parsePort(port string) (string, int, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "parsing EXPOSE port (%s)", port)
+	}
+	return port, n, nil
+}
+
+func applyLabel(image v1.Image, args []string) (v1.Image, error) {
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+
+	if cfg.Config.Labels == nil {
+		cfg.Config.Labels = map[string]string{}
+	}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid LABEL %q, expected key=value", arg)
+		}
+		cfg.Config.Labels[parts[0]] = parts[1]
+	}
+
+	return mutate.Config(image, cfg.Config)
+}
+
+func applyEntrypoint(image v1.Image, args []string) (v1.Image, error) {
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+
+	cfg.Config.Entrypoint = args
+
+	return mutate.Config(image, cfg.Config)
+}
+
+func applyCmdArgs(image v1.Image, args []string) (v1.Image, error) {
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+
+	cfg.Config.Cmd = args
+
+	return mutate.Config(image, cfg.Config)
+}
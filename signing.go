@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/google/go-containerregistry/authn"
+	"github.com/google/go-containerregistry/name"
+	v1 "github.com/google/go-containerregistry/v1"
+	"github.com/google/go-containerregistry/v1/empty"
+	"github.com/google/go-containerregistry/v1/mutate"
+	"github.com/google/go-containerregistry/v1/tarball"
+	"github.com/google/go-containerregistry/v1/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	cosignSignatureMediaType  = "application/vnd.dev.cosign.simplesigning.v1+json"
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+)
+
+// signaturePayload is the cosign "simple signing" payload format: the thing
+// that actually gets signed, identifying the image by digest and reference.
+type signaturePayload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// signAndPush signs the already-pushed image's manifest digest with the
+// ECDSA key at keyPath and pushes the signature as a sibling
+// "sha256-<digest>.sig" tag, the same convention cosign uses so that
+// signatures can be discovered without a separate transparency log lookup.
+func signAndPush(image v1.Image, destRef name.Reference, keyPath string, kc authn.Keychain) error {
+	digest, err := image.Digest()
+	if err != nil {
+		return errors.Wrap(err, "computing image digest")
+	}
+
+	key, err := loadECDSAKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	payload := signaturePayload{}
+	payload.Critical.Identity.DockerReference = destRef.Name()
+	payload.Critical.Image.DockerManifestDigest = digest.String()
+	payload.Critical.Type = "cosign container image signature"
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "marshaling signature payload")
+	}
+
+	sum := sha256.Sum256(payloadBytes)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		return errors.Wrap(err, "signing payload")
+	}
+
+	// cosign identifies a signature artifact by its config blob's media
+	// type, not the layer or the manifest, so set it there.
+	sigImage, err := blobImage(payloadBytes, map[string]string{
+		cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(signature),
+	})
+	if err != nil {
+		return errors.Wrap(err, "building signature artifact")
+	}
+	sigImage = mutate.ConfigMediaType(sigImage, cosignSignatureMediaType)
+
+	sigRef, err := siblingTag(destRef, digest, "sig")
+	if err != nil {
+		return err
+	}
+
+	return pushImage(sigImage, nil, sigRef.Name(), kc)
+}
+
+// sbomAndPush reads the SBOM document at sbomPath and pushes it as a
+// sibling "sha256-<digest>.sbom" tag carrying the raw document with its
+// appropriate media type (SPDX or CycloneDX, guessed from the extension).
+func sbomAndPush(image v1.Image, destRef name.Reference, sbomPath string, kc authn.Keychain) error {
+	digest, err := image.Digest()
+	if err != nil {
+		return errors.Wrap(err, "computing image digest")
+	}
+
+	sbom, err := ioutil.ReadFile(sbomPath)
+	if err != nil {
+		return errors.Wrapf(err, "reading SBOM (%s)", sbomPath)
+	}
+
+	// the SBOM itself is the layer, so the media type identifying its
+	// format (SPDX/CycloneDX) belongs on the layer, not the config.
+	sbomImage, err := blobImageWithLayerMediaType(sbom, types.MediaType(sbomMediaType(sbomPath)), nil)
+	if err != nil {
+		return errors.Wrap(err, "building SBOM artifact")
+	}
+
+	sbomRef, err := siblingTag(destRef, digest, "sbom")
+	if err != nil {
+		return err
+	}
+
+	return pushImage(sbomImage, nil, sbomRef.Name(), kc)
+}
+
+// blobImage wraps a single blob as a minimal OCI image: one layer holding
+// the blob verbatim, with any labels attached, matching the "config +
+// single layer" artifact shape cosign uses for signatures and SBOM
+// attestations. Callers that need a specific media type set it afterwards
+// on whichever part (config, layer, or manifest) the consuming tool
+// actually keys off of.
+func blobImage(blob []byte, labels map[string]string) (v1.Image, error) {
+	layer, err := tarball.LayerFromReader(bytes.NewReader(blob))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating artifact layer")
+	}
+
+	return layerImage(layer, labels)
+}
+
+// blobImageWithLayerMediaType is like blobImage, but tags the layer itself
+// with mediaType instead of leaving it as a generic tar layer - used for
+// artifacts (like SBOMs) that are identified by their layer's media type.
+func blobImageWithLayerMediaType(blob []byte, mediaType types.MediaType, labels map[string]string) (v1.Image, error) {
+	layer, err := tarball.LayerFromReader(bytes.NewReader(blob))
+	if err != nil {
+		return nil, errors.Wrap(err, "creating artifact layer")
+	}
+
+	return layerImage(taggedMediaTypeLayer{Layer: layer, mediaType: mediaType}, labels)
+}
+
+func layerImage(layer v1.Layer, labels map[string]string) (v1.Image, error) {
+	image, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		return nil, errors.Wrap(err, "appending artifact layer")
+	}
+
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+	cfg.Config.Labels = labels
+
+	return mutate.ConfigFile(image, cfg)
+}
+
+// taggedMediaTypeLayer overrides the media type of an underlying v1.Layer,
+// since go-containerregistry's tarball layers always report the generic
+// Docker layer media type.
+type taggedMediaTypeLayer struct {
+	v1.Layer
+	mediaType types.MediaType
+}
+
+func (l taggedMediaTypeLayer) MediaType() (types.MediaType, error) {
+	return l.mediaType, nil
+}
+
+// siblingTag derives the "sha256-<digest>.<suffix>" tag cosign-compatible
+// tooling expects to find a signature or attestation for an image at.
+func siblingTag(destRef name.Reference, digest v1.Hash, suffix string) (name.Reference, error) {
+	tag := fmt.Sprintf("%s-%s.%s", digest.Algorithm, digest.Hex, suffix)
+	ref, err := name.ParseReference(destRef.Context().Name()+":"+tag, name.WeakValidation)
+	if err != nil {
+		return nil, errors.Wrapf(err, "building sibling tag (%s)", tag)
+	}
+	return ref, nil
+}
+
+func sbomMediaType(path string) string {
+	if strings.HasSuffix(path, ".cdx.json") || strings.HasSuffix(path, ".cyclonedx.json") {
+		return "application/vnd.cyclonedx+json"
+	}
+	return "application/spdx+json"
+}
+
+func loadECDSAKey(path string) (*ecdsa.PrivateKey, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading signing key (%s)", path)
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.Errorf("no PEM block found in %s", path)
+	}
+
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing EC private key (%s)", path)
+	}
+
+	return key, nil
+}